@@ -0,0 +1,86 @@
+package attachment
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/agl/ed25519"
+)
+
+func testKeys(t *testing.T) (SecretboxKey, SignKey, VerifyKey) {
+	t.Helper()
+	var encKeyArray [SecretboxKeySize]byte
+	if _, err := rand.Read(encKeyArray[:]); err != nil {
+		t.Fatal(err)
+	}
+	verifyKey, signKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &encKeyArray, signKey, verifyKey
+}
+
+func testNonce(t *testing.T) AttachmentNonce {
+	t.Helper()
+	var nonce [AttachmentNonceSize]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		t.Fatal(err)
+	}
+	return &nonce
+}
+
+func TestCipherSuitesRoundTrip(t *testing.T) {
+	plaintext := bytes.Repeat([]byte("attachment bytes "), 100000) // multiple chunks
+	for _, suite := range []CipherSuite{SecretboxEd25519Suite, ChaCha20Poly1305HKDFSuite} {
+		encKey, signKey, verifyKey := testKeys(t)
+		nonce := testNonce(t)
+
+		sealed := SealWholeAttachmentForSuite(suite, plaintext, encKey, signKey, nonce)
+		opened, err := OpenWholeAttachment(sealed, encKey, verifyKey, nonce)
+		if err != nil {
+			t.Fatalf("suite %s: OpenWholeAttachment failed: %s", suite.Name(), err)
+		}
+		if !bytes.Equal(opened, plaintext) {
+			t.Fatalf("suite %s: round-tripped plaintext didn't match", suite.Name())
+		}
+	}
+}
+
+func TestSecretboxSuiteHasNoHeaderByte(t *testing.T) {
+	plaintext := []byte("hello")
+	encKey, signKey, _ := testKeys(t)
+	nonce := testNonce(t)
+
+	sealed := SealWholeAttachment(plaintext, encKey, signKey, nonce)
+	if sealed[0] != Bin32Tag {
+		t.Fatalf("expected the default suite to start with the bin32 tag %#x (no suite header), found %#x", Bin32Tag, sealed[0])
+	}
+}
+
+func TestChaChaSuiteHasHeaderByte(t *testing.T) {
+	plaintext := []byte("hello")
+	encKey, signKey, _ := testKeys(t)
+	nonce := testNonce(t)
+
+	sealed := SealWholeAttachmentForSuite(ChaCha20Poly1305HKDFSuite, plaintext, encKey, signKey, nonce)
+	if CipherSuiteID(sealed[0]) != SuiteChaCha20Poly1305HKDFID {
+		t.Fatalf("expected the chacha suite's id byte at the front of the stream, found %#x", sealed[0])
+	}
+}
+
+func TestCipherSuitesDetectTampering(t *testing.T) {
+	plaintext := []byte("don't modify me")
+	for _, suite := range []CipherSuite{SecretboxEd25519Suite, ChaCha20Poly1305HKDFSuite} {
+		encKey, signKey, verifyKey := testKeys(t)
+		nonce := testNonce(t)
+
+		sealed := SealWholeAttachmentForSuite(suite, plaintext, encKey, signKey, nonce)
+		tampered := append([]byte{}, sealed...)
+		tampered[len(tampered)-1] ^= 0xff // flip a bit in the final chunk's ciphertext
+
+		if _, err := OpenWholeAttachment(tampered, encKey, verifyKey, nonce); err == nil {
+			t.Fatalf("suite %s: expected an error opening a tampered attachment, got none", suite.Name())
+		}
+	}
+}
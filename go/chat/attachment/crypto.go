@@ -149,6 +149,12 @@ const SignaturePrefix = "keybase chat attachment\x00"
 const PlaintextChunkLength = 1048576 // 2^20
 const Bin32Tag = 0xc6
 const Bin32Overhead = 5 // The bin32 tag plus 4 length bytes
+
+// PacketLength is the ciphertext length of a full (non-final) chunk under
+// the original secretbox suite. Suite-aware code (anything that might be
+// dealing with a non-secretbox suite) should call getPacketLen(plaintextLen,
+// suite) instead, since a suite's AEAD overhead isn't guaranteed to match
+// secretbox's.
 const PacketLength = PlaintextChunkLength + ed25519.SignatureSize + secretbox.Overhead + Bin32Overhead
 
 // ===================================
@@ -189,16 +195,22 @@ func packCiphertext(ciphertext []byte) []byte {
 	return packet
 }
 
-func getPacketLen(plaintextLen int) int {
-	return plaintextLen + secretbox.Overhead + ed25519.SignatureSize + Bin32Overhead
+func getPacketLen(plaintextLen int, suite CipherSuite) int {
+	return plaintextLen + suite.Overhead() + ed25519.SignatureSize + Bin32Overhead
 }
 
-func sealPacket(plaintext []byte, chunkNum uint64, encKey SecretboxKey, signKey SignKey, attachmentNonce AttachmentNonce) []byte {
+func sealPacket(plaintext []byte, chunkNum uint64, encKey SecretboxKey, signKey SignKey, attachmentNonce AttachmentNonce, suite CipherSuite) []byte {
 	chunkNonce := makeChunkNonce(attachmentNonce, chunkNum)
+	// The signature binds in the root key regardless of which suite is
+	// sealing the chunk, not the suite's derived per-chunk key. That's
+	// fine: the signature is itself encrypted, and the root key already
+	// changes per attachment the same way the derived key changes per
+	// chunk.
 	signatureInput := makeSignatureInput(plaintext, encKey, chunkNonce)
 	signature := ed25519.Sign(signKey, signatureInput)
 	signedChunk := append(signature[:], plaintext...)
-	ciphertextChunk := secretbox.Seal(nil, signedChunk, chunkNonce, encKey)
+	chunkKey := suite.DeriveChunkKey(encKey, chunkNum)
+	ciphertextChunk := suite.Seal(chunkKey, chunkNonce, signedChunk)
 	packet := packCiphertext(ciphertextChunk)
 	return packet
 }
@@ -224,15 +236,16 @@ func unpackCiphertext(packet []byte) ([]byte, error) {
 	return packet[Bin32Overhead:len(packet)], nil
 }
 
-func openPacket(packet []byte, chunkNum uint64, encKey SecretboxKey, verifyKey VerifyKey, attachmentNonce AttachmentNonce) ([]byte, error) {
+func openPacket(packet []byte, chunkNum uint64, encKey SecretboxKey, verifyKey VerifyKey, attachmentNonce AttachmentNonce, suite CipherSuite) ([]byte, error) {
 	ciphertext, err := unpackCiphertext(packet)
 	if err != nil {
 		return nil, err
 	}
 	chunkNonce := makeChunkNonce(attachmentNonce, chunkNum)
-	signedChunk, secretboxValid := secretbox.Open(nil, ciphertext, chunkNonce, encKey)
-	if !secretboxValid {
-		return nil, NewAttachmentError(BadSecretbox, "secretbox failed to open")
+	chunkKey := suite.DeriveChunkKey(encKey, chunkNum)
+	signedChunk, aeadValid := suite.Open(chunkKey, chunkNonce, ciphertext)
+	if !aeadValid {
+		return nil, NewAttachmentError(BadSecretbox, "%s failed to open", suite.Name())
 	}
 	// Avoid panicking on signatures that are too short.
 	if len(signedChunk) < ed25519.SignatureSize {
@@ -254,30 +267,61 @@ func openPacket(packet []byte, chunkNum uint64, encKey SecretboxKey, verifyKey V
 // =============================
 
 type AttachmentEncoder struct {
-	encKey   SecretboxKey
-	signKey  SignKey
-	nonce    AttachmentNonce
-	buf      []byte
-	chunkNum uint64
+	encKey        SecretboxKey
+	signKey       SignKey
+	nonce         AttachmentNonce
+	suite         CipherSuite
+	buf           []byte
+	chunkNum      uint64
+	headerWritten bool
 }
 
+// NewAttachmentEncoder makes an encoder using the original secretbox +
+// ed25519 cipher suite. Use NewAttachmentEncoderForSuite to pick a
+// different suite.
 func NewAttachmentEncoder(encKey SecretboxKey, signKey SignKey, nonce AttachmentNonce) *AttachmentEncoder {
+	return NewAttachmentEncoderForSuite(SecretboxEd25519Suite, encKey, signKey, nonce)
+}
+
+// NewAttachmentEncoderForSuite makes an encoder that seals each chunk with
+// the given CipherSuite. Suites other than SecretboxEd25519Suite prefix the
+// sealed stream with a 1-byte suite identifier, so NewAttachmentDecoder can
+// auto-detect which suite to use without the caller having to remember it
+// out of band. SecretboxEd25519Suite never gets that prefix, so streams
+// sealed before CipherSuite existed, and streams sealed with the default
+// suite today, are byte-for-byte identical.
+func NewAttachmentEncoderForSuite(suite CipherSuite, encKey SecretboxKey, signKey SignKey, nonce AttachmentNonce) *AttachmentEncoder {
 	return &AttachmentEncoder{
 		encKey:   encKey,
 		signKey:  signKey,
 		nonce:    nonce,
+		suite:    suite,
 		buf:      nil,
 		chunkNum: 0,
 	}
 }
 
+func (e *AttachmentEncoder) maybeHeader() []byte {
+	if e.headerWritten {
+		return nil
+	}
+	e.headerWritten = true
+	// The original secretbox suite never gets a header byte, so that
+	// streams sealed before CipherSuite existed (and streams sealed with
+	// the default suite today) keep working unchanged.
+	if e.suite.ID() == SuiteSecretboxEd25519ID {
+		return nil
+	}
+	return []byte{byte(e.suite.ID())}
+}
+
 func (e *AttachmentEncoder) sealOnePacket(plaintextLen int) []byte {
 	// Note that this function handles the `plaintextLen == 0` case.
 	if plaintextLen > len(e.buf) {
 		panic("encoder tried to seal a packet that was too big")
 	}
 	plaintextChunk := e.buf[0:plaintextLen]
-	packet := sealPacket(plaintextChunk, e.chunkNum, e.encKey, e.signKey, e.nonce)
+	packet := sealPacket(plaintextChunk, e.chunkNum, e.encKey, e.signKey, e.nonce, e.suite)
 	e.buf = e.buf[plaintextLen:len(e.buf)]
 	e.chunkNum++
 	return packet
@@ -289,8 +333,8 @@ func (e *AttachmentEncoder) sealOnePacket(plaintextLen int) []byte {
 // Otherwise you will both lose data and cause truncation errors on
 // decoding.
 func (e *AttachmentEncoder) Write(plaintext []byte) []byte {
+	output := e.maybeHeader()
 	e.buf = append(e.buf, plaintext...)
-	var output []byte
 	// If buf is big enough to make new packets, make as many as we can.
 	for len(e.buf) >= PlaintextChunkLength {
 		packet := e.sealOnePacket(PlaintextChunkLength)
@@ -306,8 +350,9 @@ func (e *AttachmentEncoder) Finish() []byte {
 	if len(e.buf) >= PlaintextChunkLength {
 		panic("encoder buffer has more bytes than expected")
 	}
+	output := e.maybeHeader()
 	packet := e.sealOnePacket(len(e.buf))
-	return packet
+	return append(output, packet...)
 }
 
 // =============================
@@ -315,14 +360,22 @@ func (e *AttachmentEncoder) Finish() []byte {
 // =============================
 
 type AttachmentDecoder struct {
-	encKey    SecretboxKey
-	verifyKey VerifyKey
-	nonce     AttachmentNonce
-	buf       []byte
-	chunkNum  uint64
-	err       error
+	encKey        SecretboxKey
+	verifyKey     VerifyKey
+	nonce         AttachmentNonce
+	suite         CipherSuite
+	fullPacketLen int
+	buf           []byte
+	chunkNum      uint64
+	err           error
 }
 
+// NewAttachmentDecoder makes a decoder that auto-detects which CipherSuite
+// sealed the stream. A leading byte equal to Bin32Tag means there's no
+// suite-identifier byte at all: that's a stream sealed before CipherSuite
+// existed (or with the default suite today), which is always secretbox.
+// Any other leading byte is read as a CipherSuiteID. Either way, callers
+// don't need to know in advance which suite the sender used.
 func NewAttachmentDecoder(encKey SecretboxKey, verifyKey VerifyKey, nonce AttachmentNonce) *AttachmentDecoder {
 	return &AttachmentDecoder{
 		encKey:    encKey,
@@ -334,12 +387,40 @@ func NewAttachmentDecoder(encKey SecretboxKey, verifyKey VerifyKey, nonce Attach
 	}
 }
 
+// ensureSuite consumes the leading suite-identifier byte the first time
+// enough input is available, and picks the CipherSuite to decode with. It
+// returns false if there isn't a byte to read yet.
+func (d *AttachmentDecoder) ensureSuite() (bool, error) {
+	if d.suite != nil {
+		return true, nil
+	}
+	if len(d.buf) < 1 {
+		return false, nil
+	}
+	if d.buf[0] == Bin32Tag {
+		// No suite-identifier byte: the bin32 tag we're looking at is the
+		// start of the first packet itself, the same as every stream
+		// sealed before CipherSuite existed.
+		d.suite = SecretboxEd25519Suite
+		d.fullPacketLen = getPacketLen(PlaintextChunkLength, d.suite)
+		return true, nil
+	}
+	suite, err := CipherSuiteByID(CipherSuiteID(d.buf[0]))
+	if err != nil {
+		return false, err
+	}
+	d.suite = suite
+	d.fullPacketLen = getPacketLen(PlaintextChunkLength, suite)
+	d.buf = d.buf[1:]
+	return true, nil
+}
+
 func (d *AttachmentDecoder) openOnePacket(packetLen int) ([]byte, error) {
 	if packetLen > len(d.buf) {
 		panic("decoder tried to open a packet that was too big")
 	}
 	packet := d.buf[0:packetLen]
-	plaintext, err := openPacket(packet, d.chunkNum, d.encKey, d.verifyKey, d.nonce)
+	plaintext, err := openPacket(packet, d.chunkNum, d.encKey, d.verifyKey, d.nonce, d.suite)
 	if err != nil {
 		return nil, err
 	}
@@ -360,13 +441,21 @@ func (d *AttachmentDecoder) Write(ciphertext []byte) ([]byte, error) {
 		return nil, d.err
 	}
 	d.buf = append(d.buf, ciphertext...)
+	ready, err := d.ensureSuite()
+	if err != nil {
+		d.err = err
+		return nil, d.err
+	}
+	if !ready {
+		return nil, nil
+	}
 	// If buf is big enough to open new packets, open as many as we can.
 	// We assume that every packet other than the last (which we handle in
 	// Finish) is the same length, which makes this loop very simple.
 	var output []byte
-	for len(d.buf) >= PacketLength {
+	for len(d.buf) >= d.fullPacketLen {
 		var plaintext []byte
-		plaintext, d.err = d.openOnePacket(PacketLength)
+		plaintext, d.err = d.openOnePacket(d.fullPacketLen)
 		if d.err != nil {
 			return nil, d.err
 		}
@@ -384,7 +473,14 @@ func (d *AttachmentDecoder) Finish() ([]byte, error) {
 	if d.err != nil {
 		return nil, d.err
 	}
-	if len(d.buf) >= PacketLength {
+	if ready, err := d.ensureSuite(); err != nil {
+		d.err = err
+		return nil, d.err
+	} else if !ready {
+		d.err = NewAttachmentError(ShortMessagePackObject, "stream ended before the suite identifier byte")
+		return nil, d.err
+	}
+	if len(d.buf) >= d.fullPacketLen {
 		panic("decoder buffer has more bytes than expected")
 	}
 	// If we've been truncated at a packet boundary, this open will fail on a
@@ -399,24 +495,48 @@ func (d *AttachmentDecoder) Finish() ([]byte, error) {
 // all-at-once wrapper functions
 // =============================
 
+// GetSealedSize returns the sealed size of a plaintextLen-byte attachment
+// under the original secretbox suite. Use GetSealedSizeForSuite for a
+// different suite.
 func GetSealedSize(plaintextLen int) int {
+	return GetSealedSizeForSuite(SecretboxEd25519Suite, plaintextLen)
+}
+
+// GetSealedSizeForSuite is GetSealedSize, but for a sealed stream using the
+// given CipherSuite instead of always assuming secretbox.
+func GetSealedSizeForSuite(suite CipherSuite, plaintextLen int) int {
 	// All the full packets.
 	fullChunks := plaintextLen / PlaintextChunkLength
-	totalLen := fullChunks * getPacketLen(PlaintextChunkLength)
+	totalLen := fullChunks * getPacketLen(PlaintextChunkLength, suite)
 	// Maybe a partial packet.
 	remainingPlaintext := plaintextLen % PlaintextChunkLength
-	totalLen += getPacketLen(remainingPlaintext)
-	// And finally, an empty packet.
+	totalLen += getPacketLen(remainingPlaintext, suite)
+	// Suites other than the default get a leading suite-identifier byte;
+	// see AttachmentEncoder.maybeHeader.
+	if suite.ID() != SuiteSecretboxEd25519ID {
+		totalLen++
+	}
 	return totalLen
 }
 
+// SealWholeAttachment seals plaintext with the original secretbox +
+// ed25519 cipher suite. Use SealWholeAttachmentForSuite to pick a
+// different suite.
 func SealWholeAttachment(plaintext []byte, encKey SecretboxKey, signKey SignKey, nonce AttachmentNonce) []byte {
-	encoder := NewAttachmentEncoder(encKey, signKey, nonce)
+	return SealWholeAttachmentForSuite(SecretboxEd25519Suite, plaintext, encKey, signKey, nonce)
+}
+
+// SealWholeAttachmentForSuite is SealWholeAttachment, but sealing each
+// chunk with the given CipherSuite instead of always using secretbox.
+func SealWholeAttachmentForSuite(suite CipherSuite, plaintext []byte, encKey SecretboxKey, signKey SignKey, nonce AttachmentNonce) []byte {
+	encoder := NewAttachmentEncoderForSuite(suite, encKey, signKey, nonce)
 	output := encoder.Write(plaintext)
 	output = append(output, encoder.Finish()...)
 	return output
 }
 
+// OpenWholeAttachment auto-detects which CipherSuite sealed the stream, so
+// it works regardless of which suite SealWholeAttachment(ForSuite) used.
 func OpenWholeAttachment(sealed []byte, encKey SecretboxKey, verifyKey VerifyKey, nonce AttachmentNonce) ([]byte, error) {
 	decoder := NewAttachmentDecoder(encKey, verifyKey, nonce)
 	output, err := decoder.Write(sealed)
@@ -443,6 +563,7 @@ const (
 	ShortMessagePackObject
 	WrongMessagePackFormat
 	WrongMessagePackLength
+	UnknownCipherSuite
 )
 
 type AttachmentCryptoError struct {
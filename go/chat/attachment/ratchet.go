@@ -0,0 +1,242 @@
+package attachment
+
+import "encoding/binary"
+
+// This file adds a forward-secret mode for attachments that are really
+// long-lived streams (voice notes, live screen share, logs) rather than
+// one-shot files, where a single fixed key would mean a later compromise
+// exposes the whole past stream. Instead of a fixed root key, we keep a
+// chain key and step it forward every DefaultRatchetInterval chunks, the
+// same chain-key recurrence Axolotl/Double Ratchet use: each step derives
+// the next chain key from the current one with HKDF and wipes the old
+// value, so recovering a later chain key doesn't recover earlier chunks.
+//
+// The chunk key for chunk N is derived from the *current* chain key and N,
+// so it already changes every chunk even within one ratchet interval; the
+// chain only steps (and forgets the old value) once every
+// DefaultRatchetInterval chunks. The chunk number the format already
+// carries is the only ratchet state, so this composes with
+// sealPacket/openPacket unchanged. The stream does carry one byte more than
+// a default secretbox stream: it starts with the SuiteSecretboxEd25519ID
+// byte, which the ratcheting decoder requires and consumes.
+
+// DefaultRatchetInterval is how many chunks share a chain key before it
+// steps forward, if the caller doesn't ask for a different interval.
+const DefaultRatchetInterval = 64
+
+const ratchetChunkKeyInfo = "chunk-key"
+const ratchetChainStepInfo = "chain-step"
+
+func ratchetChunkKey(chainKey *[32]byte, chunkNum uint64) SecretboxKey {
+	var chunkNumBytes [8]byte
+	binary.BigEndian.PutUint64(chunkNumBytes[:], chunkNum)
+	info := append([]byte(ratchetChunkKeyInfo), chunkNumBytes[:]...)
+	chunkKey := hkdfExpand(chainKey[:], info)
+	return &chunkKey
+}
+
+func ratchetStepChain(chainKey *[32]byte) {
+	next := hkdfExpand(chainKey[:], []byte(ratchetChainStepInfo))
+	// Wipe the old chain key; it must not be recoverable once we've
+	// stepped past it.
+	for i := range chainKey {
+		chainKey[i] = 0
+	}
+	*chainKey = next
+}
+
+// =============================
+// ratcheting attachment encoding
+// =============================
+
+type RatchetingAttachmentEncoder struct {
+	chainKey      [32]byte
+	signKey       SignKey
+	nonce         AttachmentNonce
+	interval      uint64
+	buf           []byte
+	chunkNum      uint64
+	headerWritten bool
+}
+
+// NewRatchetingAttachmentEncoder makes a ratcheting encoder that steps its
+// chain key every DefaultRatchetInterval chunks. Use
+// NewRatchetingAttachmentEncoderWithInterval to pick a different interval.
+func NewRatchetingAttachmentEncoder(rootKey SecretboxKey, signKey SignKey, nonce AttachmentNonce) *RatchetingAttachmentEncoder {
+	return NewRatchetingAttachmentEncoderWithInterval(rootKey, signKey, nonce, DefaultRatchetInterval)
+}
+
+// NewRatchetingAttachmentEncoderWithInterval is NewRatchetingAttachmentEncoder,
+// but stepping the chain key every `interval` chunks instead of
+// DefaultRatchetInterval.
+func NewRatchetingAttachmentEncoderWithInterval(rootKey SecretboxKey, signKey SignKey, nonce AttachmentNonce, interval uint64) *RatchetingAttachmentEncoder {
+	e := &RatchetingAttachmentEncoder{
+		signKey:  signKey,
+		nonce:    nonce,
+		interval: interval,
+	}
+	copy(e.chainKey[:], rootKey[:])
+	return e
+}
+
+func (e *RatchetingAttachmentEncoder) maybeHeader() []byte {
+	if e.headerWritten {
+		return nil
+	}
+	e.headerWritten = true
+	return []byte{byte(SuiteSecretboxEd25519ID)}
+}
+
+func (e *RatchetingAttachmentEncoder) sealOnePacket(plaintextLen int) []byte {
+	if plaintextLen > len(e.buf) {
+		panic("encoder tried to seal a packet that was too big")
+	}
+	plaintextChunk := e.buf[0:plaintextLen]
+	chunkKey := ratchetChunkKey(&e.chainKey, e.chunkNum)
+	packet := sealPacket(plaintextChunk, e.chunkNum, chunkKey, e.signKey, e.nonce, SecretboxEd25519Suite)
+	e.buf = e.buf[plaintextLen:len(e.buf)]
+	e.chunkNum++
+	if e.chunkNum%e.interval == 0 {
+		ratchetStepChain(&e.chainKey)
+	}
+	return packet
+}
+
+// Write plaintext bytes into the encoder. See AttachmentEncoder.Write;
+// this behaves the same way, just deriving a fresh key for every chunk and
+// stepping the chain key every interval chunks.
+func (e *RatchetingAttachmentEncoder) Write(plaintext []byte) []byte {
+	output := e.maybeHeader()
+	e.buf = append(e.buf, plaintext...)
+	for len(e.buf) >= PlaintextChunkLength {
+		packet := e.sealOnePacket(PlaintextChunkLength)
+		output = append(output, packet...)
+	}
+	return output
+}
+
+// Finish flushes any remaining buffered bytes as a final short chunk. See
+// AttachmentEncoder.Finish.
+func (e *RatchetingAttachmentEncoder) Finish() []byte {
+	if len(e.buf) >= PlaintextChunkLength {
+		panic("encoder buffer has more bytes than expected")
+	}
+	output := e.maybeHeader()
+	packet := e.sealOnePacket(len(e.buf))
+	return append(output, packet...)
+}
+
+// =============================
+// ratcheting attachment decoding
+// =============================
+
+type RatchetingAttachmentDecoder struct {
+	chainKey  [32]byte
+	verifyKey VerifyKey
+	nonce     AttachmentNonce
+	interval  uint64
+	buf       []byte
+	chunkNum  uint64
+	suiteRead bool
+	err       error
+}
+
+// NewRatchetingAttachmentDecoder makes a decoder matching an encoder built
+// with NewRatchetingAttachmentEncoder (interval DefaultRatchetInterval).
+func NewRatchetingAttachmentDecoder(rootKey SecretboxKey, verifyKey VerifyKey, nonce AttachmentNonce) *RatchetingAttachmentDecoder {
+	return NewRatchetingAttachmentDecoderWithInterval(rootKey, verifyKey, nonce, DefaultRatchetInterval)
+}
+
+// NewRatchetingAttachmentDecoderWithInterval matches an encoder built with
+// NewRatchetingAttachmentEncoderWithInterval; interval must be the same on
+// both ends.
+func NewRatchetingAttachmentDecoderWithInterval(rootKey SecretboxKey, verifyKey VerifyKey, nonce AttachmentNonce, interval uint64) *RatchetingAttachmentDecoder {
+	d := &RatchetingAttachmentDecoder{
+		verifyKey: verifyKey,
+		nonce:     nonce,
+		interval:  interval,
+	}
+	copy(d.chainKey[:], rootKey[:])
+	return d
+}
+
+func (d *RatchetingAttachmentDecoder) ensureSuite() (bool, error) {
+	if d.suiteRead {
+		return true, nil
+	}
+	if len(d.buf) < 1 {
+		return false, nil
+	}
+	if CipherSuiteID(d.buf[0]) != SuiteSecretboxEd25519ID {
+		return false, NewAttachmentError(UnknownCipherSuite,
+			"ratcheting decoder expects a secretbox stream, found suite id %d", d.buf[0])
+	}
+	d.suiteRead = true
+	d.buf = d.buf[1:]
+	return true, nil
+}
+
+func (d *RatchetingAttachmentDecoder) openOnePacket(packetLen int) ([]byte, error) {
+	if packetLen > len(d.buf) {
+		panic("decoder tried to open a packet that was too big")
+	}
+	packet := d.buf[0:packetLen]
+	chunkKey := ratchetChunkKey(&d.chainKey, d.chunkNum)
+	plaintext, err := openPacket(packet, d.chunkNum, chunkKey, d.verifyKey, d.nonce, SecretboxEd25519Suite)
+	if err != nil {
+		return nil, err
+	}
+	d.buf = d.buf[packetLen:len(d.buf)]
+	d.chunkNum++
+	if d.chunkNum%d.interval == 0 {
+		ratchetStepChain(&d.chainKey)
+	}
+	return plaintext, nil
+}
+
+// Write ciphertext bytes into the decoder. See AttachmentDecoder.Write.
+func (d *RatchetingAttachmentDecoder) Write(ciphertext []byte) ([]byte, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	d.buf = append(d.buf, ciphertext...)
+	ready, err := d.ensureSuite()
+	if err != nil {
+		d.err = err
+		return nil, d.err
+	}
+	if !ready {
+		return nil, nil
+	}
+	var output []byte
+	for len(d.buf) >= PacketLength {
+		var plaintext []byte
+		plaintext, d.err = d.openOnePacket(PacketLength)
+		if d.err != nil {
+			return nil, d.err
+		}
+		output = append(output, plaintext...)
+	}
+	return output, nil
+}
+
+// Finish decodes any remaining bytes as the final short chunk. See
+// AttachmentDecoder.Finish.
+func (d *RatchetingAttachmentDecoder) Finish() ([]byte, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	if ready, err := d.ensureSuite(); err != nil {
+		d.err = err
+		return nil, d.err
+	} else if !ready {
+		d.err = NewAttachmentError(ShortMessagePackObject, "stream ended before the suite identifier byte")
+		return nil, d.err
+	}
+	if len(d.buf) >= PacketLength {
+		panic("decoder buffer has more bytes than expected")
+	}
+	var plaintext []byte
+	plaintext, d.err = d.openOnePacket(len(d.buf))
+	return plaintext, d.err
+}
@@ -0,0 +1,71 @@
+package attachment
+
+import (
+	"bytes"
+	"testing"
+)
+
+func sealWithRatchet(e *RatchetingAttachmentEncoder, plaintext []byte) []byte {
+	output := e.Write(plaintext)
+	return append(output, e.Finish()...)
+}
+
+func TestRatchetingAttachmentRoundTrip(t *testing.T) {
+	rootKey, signKey, verifyKey := testKeys(t)
+	nonce := testNonce(t)
+
+	// A small interval and several chunks worth of plaintext, so the test
+	// actually exercises more than one chain step.
+	const interval = 2
+	plaintext := bytes.Repeat([]byte("voice note bytes"), 500000)
+
+	encoder := NewRatchetingAttachmentEncoderWithInterval(rootKey, signKey, nonce, interval)
+	sealed := sealWithRatchet(encoder, plaintext)
+
+	decoder := NewRatchetingAttachmentDecoderWithInterval(rootKey, verifyKey, nonce, interval)
+	output, err := decoder.Write(sealed)
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	moreOutput, err := decoder.Finish()
+	if err != nil {
+		t.Fatalf("Finish failed: %s", err)
+	}
+	opened := append(output, moreOutput...)
+
+	if !bytes.Equal(opened, plaintext) {
+		t.Fatal("round-tripped plaintext didn't match")
+	}
+}
+
+func TestRatchetingAttachmentDetectsTampering(t *testing.T) {
+	rootKey, signKey, verifyKey := testKeys(t)
+	nonce := testNonce(t)
+	plaintext := []byte("don't splice a later chunk back in")
+
+	encoder := NewRatchetingAttachmentEncoder(rootKey, signKey, nonce)
+	sealed := sealWithRatchet(encoder, plaintext)
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)-1] ^= 0xff
+
+	decoder := NewRatchetingAttachmentDecoder(rootKey, verifyKey, nonce)
+	if _, err := decoder.Write(tampered); err == nil {
+		if _, err := decoder.Finish(); err == nil {
+			t.Fatal("expected an error opening a tampered ratcheting attachment, got none")
+		}
+	}
+}
+
+func TestRatchetingChunkKeysDifferAcrossChainSteps(t *testing.T) {
+	rootKey, _, _ := testKeys(t)
+	var chainKey [32]byte
+	copy(chainKey[:], rootKey[:])
+
+	firstKey := ratchetChunkKey(&chainKey, 0)
+	ratchetStepChain(&chainKey)
+	secondKey := ratchetChunkKey(&chainKey, 0)
+
+	if bytes.Equal(firstKey[:], secondKey[:]) {
+		t.Fatal("expected the chunk key for chunk 0 to differ across a chain step")
+	}
+}
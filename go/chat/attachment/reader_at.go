@@ -0,0 +1,186 @@
+package attachment
+
+import (
+	"container/list"
+	"io"
+	"sync"
+
+	"github.com/agl/ed25519"
+)
+
+// Because every full packet under a given suite is exactly the same
+// length, and only the final packet is shorter, the sealed format is
+// implicitly random-access:
+// reading plaintext byte offset P only requires decrypting the single
+// chunk that contains it. This file exposes that as an io.ReaderAt, which
+// is a big win for things like thumbnailing and HTTP Range requests that
+// shouldn't have to buffer (or even see) the rest of the attachment.
+
+// attachmentReaderAtCacheSize bounds how many decrypted chunks
+// attachmentReaderAt keeps around, so that sequential reads within a
+// chunk, or re-reads of a recently seen chunk, don't re-decrypt it.
+const attachmentReaderAtCacheSize = 4
+
+type attachmentReaderAt struct {
+	r         io.ReaderAt
+	encKey    SecretboxKey
+	verifyKey VerifyKey
+	nonce     AttachmentNonce
+	suite     CipherSuite
+
+	headerLen      int   // 0 for the default secretbox suite, 1 for any other suite
+	fullPacketLen  int   // ciphertext length of a full, non-final packet under suite
+	fullChunkCount int64 // number of full PlaintextChunkLength chunks before the last, short one
+	lastChunkLen   int   // plaintext length of the final chunk
+
+	mu    sync.Mutex
+	cache map[int64][]byte
+	order *list.List // front = most recently used chunk number
+}
+
+// NewAttachmentReaderAt returns an io.ReaderAt over the plaintext of a
+// sealed attachment stored in r, whose total sealed size (as computed by
+// GetSealedSizeForSuite for the suite that sealed it) is sealedSize. It
+// reads and verifies the final chunk up
+// front, both to detect the cipher suite and to make sure the stream isn't
+// truncated before any caller relies on random access into it.
+func NewAttachmentReaderAt(r io.ReaderAt, sealedSize int64, encKey SecretboxKey, verifyKey VerifyKey, nonce AttachmentNonce) (io.ReaderAt, error) {
+	if sealedSize < 1 {
+		return nil, NewAttachmentError(ShortMessagePackObject, "sealed attachment too short: %d bytes", sealedSize)
+	}
+	var firstByte [1]byte
+	if _, err := r.ReadAt(firstByte[:], 0); err != nil {
+		return nil, err
+	}
+	// See AttachmentDecoder.ensureSuite: a leading Bin32Tag byte means
+	// there's no suite-identifier byte at all, and this is (as every
+	// stream sealed before CipherSuite existed is) secretbox.
+	var suite CipherSuite
+	var headerLen int
+	if firstByte[0] == Bin32Tag {
+		suite = SecretboxEd25519Suite
+		headerLen = 0
+	} else {
+		var err error
+		suite, err = CipherSuiteByID(CipherSuiteID(firstByte[0]))
+		if err != nil {
+			return nil, err
+		}
+		headerLen = 1
+	}
+
+	fullPacketLen := getPacketLen(PlaintextChunkLength, suite)
+	minPacketLen := int64(getPacketLen(0, suite))
+
+	ciphertextLen := sealedSize - int64(headerLen)
+	fullChunkCount := ciphertextLen / int64(fullPacketLen)
+	lastPacketLen := ciphertextLen % int64(fullPacketLen)
+	if lastPacketLen == 0 || lastPacketLen < minPacketLen {
+		return nil, NewAttachmentError(ShortMessagePackObject,
+			"sealed attachment is truncated: final packet is %d bytes", lastPacketLen)
+	}
+
+	ra := &attachmentReaderAt{
+		r:              r,
+		encKey:         encKey,
+		verifyKey:      verifyKey,
+		nonce:          nonce,
+		suite:          suite,
+		headerLen:      headerLen,
+		fullPacketLen:  fullPacketLen,
+		fullChunkCount: fullChunkCount,
+		lastChunkLen:   int(lastPacketLen) - ed25519.SignatureSize - Bin32Overhead - suite.Overhead(),
+		cache:          make(map[int64][]byte),
+		order:          list.New(),
+	}
+	// Validating the tail packet up front is how we catch truncation: a
+	// stream cut off in the middle of its final chunk fails to verify
+	// here, instead of silently serving partial data to a later ReadAt.
+	if _, err := ra.openChunk(fullChunkCount); err != nil {
+		return nil, err
+	}
+	return ra, nil
+}
+
+func (ra *attachmentReaderAt) chunkPacketOffset(chunkNum int64) int64 {
+	return int64(ra.headerLen) + chunkNum*int64(ra.fullPacketLen)
+}
+
+func (ra *attachmentReaderAt) chunkPacketLen(chunkNum int64) int {
+	if chunkNum < ra.fullChunkCount {
+		return ra.fullPacketLen
+	}
+	return ra.lastChunkLen + ed25519.SignatureSize + Bin32Overhead + ra.suite.Overhead()
+}
+
+func (ra *attachmentReaderAt) openChunk(chunkNum int64) ([]byte, error) {
+	ra.mu.Lock()
+	if plaintext, ok := ra.cache[chunkNum]; ok {
+		ra.touch(chunkNum)
+		ra.mu.Unlock()
+		return plaintext, nil
+	}
+	ra.mu.Unlock()
+
+	packet := make([]byte, ra.chunkPacketLen(chunkNum))
+	if _, err := ra.r.ReadAt(packet, ra.chunkPacketOffset(chunkNum)); err != nil {
+		return nil, err
+	}
+	plaintext, err := openPacket(packet, uint64(chunkNum), ra.encKey, ra.verifyKey, ra.nonce, ra.suite)
+	if err != nil {
+		return nil, err
+	}
+
+	ra.mu.Lock()
+	ra.cache[chunkNum] = plaintext
+	ra.touch(chunkNum)
+	for int64(len(ra.cache)) > attachmentReaderAtCacheSize {
+		oldest := ra.order.Back()
+		ra.order.Remove(oldest)
+		delete(ra.cache, oldest.Value.(int64))
+	}
+	ra.mu.Unlock()
+	return plaintext, nil
+}
+
+// touch moves chunkNum to the front of the LRU list, adding it if it's not
+// already there. Callers must hold ra.mu.
+func (ra *attachmentReaderAt) touch(chunkNum int64) {
+	for e := ra.order.Front(); e != nil; e = e.Next() {
+		if e.Value.(int64) == chunkNum {
+			ra.order.MoveToFront(e)
+			return
+		}
+	}
+	ra.order.PushFront(chunkNum)
+}
+
+func (ra *attachmentReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, NewAttachmentError(ShortMessagePackObject, "negative ReadAt offset: %d", off)
+	}
+	plaintextLen := ra.fullChunkCount*PlaintextChunkLength + int64(ra.lastChunkLen)
+	if off >= plaintextLen {
+		return 0, io.EOF
+	}
+
+	var n int
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= plaintextLen {
+			break
+		}
+		chunkNum := pos / PlaintextChunkLength
+		chunk, err := ra.openChunk(chunkNum)
+		if err != nil {
+			return n, err
+		}
+		chunkOffset := int(pos % PlaintextChunkLength)
+		copied := copy(p[n:], chunk[chunkOffset:])
+		n += copied
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
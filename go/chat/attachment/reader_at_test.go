@@ -0,0 +1,80 @@
+package attachment
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAttachmentReaderAtRoundTrip(t *testing.T) {
+	encKey, signKey, verifyKey := testKeys(t)
+	nonce := testNonce(t)
+
+	// Several full chunks plus a short final one, so reads exercise chunk
+	// boundaries and not just a single packet.
+	plaintext := bytes.Repeat([]byte("r"), 2*PlaintextChunkLength+100)
+	sealed := SealWholeAttachment(plaintext, encKey, signKey, nonce)
+
+	ra, err := NewAttachmentReaderAt(bytes.NewReader(sealed), int64(len(sealed)), encKey, verifyKey, nonce)
+	if err != nil {
+		t.Fatalf("NewAttachmentReaderAt failed: %s", err)
+	}
+
+	// A read that crosses a chunk boundary.
+	boundary := PlaintextChunkLength
+	buf := make([]byte, 200)
+	n, err := ra.ReadAt(buf, int64(boundary-100))
+	if err != nil {
+		t.Fatalf("ReadAt across chunk boundary failed: %s", err)
+	}
+	if n != len(buf) || !bytes.Equal(buf, plaintext[boundary-100:boundary+100]) {
+		t.Fatal("ReadAt across a chunk boundary didn't match the original plaintext")
+	}
+
+	// A read right up against the end of the attachment.
+	tailBuf := make([]byte, 50)
+	n, err = ra.ReadAt(tailBuf, int64(len(plaintext)-50))
+	if err != nil {
+		t.Fatalf("ReadAt at the tail failed: %s", err)
+	}
+	if !bytes.Equal(tailBuf[:n], plaintext[len(plaintext)-50:]) {
+		t.Fatal("tail ReadAt didn't match the original plaintext")
+	}
+
+	// A read starting past the end of the attachment.
+	if _, err := ra.ReadAt(make([]byte, 10), int64(len(plaintext))); err == nil {
+		t.Fatal("expected io.EOF reading past the end of the attachment, got none")
+	}
+}
+
+func TestAttachmentReaderAtDetectsTamperedChunk(t *testing.T) {
+	encKey, signKey, verifyKey := testKeys(t)
+	nonce := testNonce(t)
+
+	plaintext := bytes.Repeat([]byte("s"), 2*PlaintextChunkLength+100)
+	sealed := SealWholeAttachment(plaintext, encKey, signKey, nonce)
+	// Flip a byte inside the first chunk's ciphertext, well away from the
+	// final chunk that NewAttachmentReaderAt validates up front.
+	sealed[10] ^= 0xff
+
+	ra, err := NewAttachmentReaderAt(bytes.NewReader(sealed), int64(len(sealed)), encKey, verifyKey, nonce)
+	if err != nil {
+		// Tampering with the leading bytes is also allowed to be caught here.
+		return
+	}
+	if _, err := ra.ReadAt(make([]byte, 10), 0); err == nil {
+		t.Fatal("expected an error reading a tampered chunk, got none")
+	}
+}
+
+func TestAttachmentReaderAtDetectsTruncation(t *testing.T) {
+	encKey, signKey, verifyKey := testKeys(t)
+	nonce := testNonce(t)
+
+	plaintext := bytes.Repeat([]byte("t"), 2*PlaintextChunkLength+100)
+	sealed := SealWholeAttachment(plaintext, encKey, signKey, nonce)
+	truncated := sealed[:len(sealed)-10]
+
+	if _, err := NewAttachmentReaderAt(bytes.NewReader(truncated), int64(len(truncated)), encKey, verifyKey, nonce); err == nil {
+		t.Fatal("expected an error constructing a reader over a truncated attachment, got none")
+	}
+}
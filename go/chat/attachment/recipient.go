@@ -0,0 +1,99 @@
+package attachment
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+// This file lets a sender seal an attachment for one or more recipients
+// without arranging a shared secretbox key out of band. We generate a
+// fresh content key, seal the body under it with the usual chunked Seal
+// construction, and then wrap that content key once per recipient with an
+// X25519 ephemeral key agreement (nacl/box), the same primitive used for
+// device provisioning elsewhere in this client. The sign-then-encrypt
+// authenticity guarantee is unchanged: the content key is still bound into
+// every chunk's signature, exactly as if the sender and recipient had
+// exchanged it directly.
+
+// recipientHeaderEntrySize is one recipient's slot in the header: an
+// ephemeral X25519 public key, plus the content key boxed to the
+// recipient.
+const recipientHeaderEntrySize = 32 + SecretboxKeySize + box.Overhead
+
+const recipientCountSize = 4
+
+// Ephemeral box keys are used to wrap exactly one content key and then
+// discarded, so (like the all-zero AttachmentNonce this package's design
+// notes expect for one-time secretbox keys) a fixed nonce is safe here: reuse can
+// only happen if an ephemeral key is reused, and it never is.
+var recipientBoxNonce [24]byte
+
+// SealAttachmentForRecipients encrypts plaintext under a freshly generated
+// content key using the existing chunked Seal construction, then emits a
+// header that wraps the content key to each of recipientPubKeys via an
+// X25519 ephemeral key agreement. Recipients only need their own private
+// key to recover the content key and open body with
+// OpenAttachmentForRecipient; they never need a pre-shared symmetric key.
+func SealAttachmentForRecipients(plaintext []byte, signKey SignKey, recipientPubKeys []*[32]byte) (header []byte, body []byte, err error) {
+	var contentKeyArray [SecretboxKeySize]byte
+	if _, err := rand.Read(contentKeyArray[:]); err != nil {
+		return nil, nil, err
+	}
+	contentKey := SecretboxKey(&contentKeyArray)
+
+	body = SealWholeAttachment(plaintext, contentKey, signKey, zeroAttachmentNonce())
+
+	header = make([]byte, recipientCountSize)
+	binary.BigEndian.PutUint32(header, uint32(len(recipientPubKeys)))
+	for _, recipientPubKey := range recipientPubKeys {
+		ephemeralPub, ephemeralPriv, err := box.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		boxedContentKey := box.Seal(nil, contentKeyArray[:], &recipientBoxNonce, recipientPubKey, ephemeralPriv)
+		header = append(header, ephemeralPub[:]...)
+		header = append(header, boxedContentKey...)
+	}
+	return header, body, nil
+}
+
+// OpenAttachmentForRecipient reverses SealAttachmentForRecipients. It scans
+// the header for the entry myPrivKey can unwrap, recovers the content key,
+// and drives the existing AttachmentDecoder over body with it.
+func OpenAttachmentForRecipient(header []byte, body []byte, myPrivKey *[32]byte, verifyKey VerifyKey) ([]byte, error) {
+	if len(header) < recipientCountSize {
+		return nil, NewAttachmentError(ShortMessagePackObject,
+			"recipient header too short: %d bytes", len(header))
+	}
+	count := binary.BigEndian.Uint32(header[0:recipientCountSize])
+	entries := header[recipientCountSize:]
+	if uint64(len(entries)) != uint64(count)*uint64(recipientHeaderEntrySize) {
+		return nil, NewAttachmentError(WrongMessagePackLength,
+			"recipient header length doesn't match its entry count: %d entries, %d bytes", count, len(entries))
+	}
+	for i := uint32(0); i < count; i++ {
+		entry := entries[i*recipientHeaderEntrySize : (i+1)*recipientHeaderEntrySize]
+		var ephemeralPub [32]byte
+		copy(ephemeralPub[:], entry[0:32])
+		boxedContentKey := entry[32:]
+		contentKeyBytes, ok := box.Open(nil, boxedContentKey, &recipientBoxNonce, &ephemeralPub, myPrivKey)
+		if !ok {
+			// Not the entry meant for this recipient; keep looking.
+			continue
+		}
+		var contentKeyArray [SecretboxKeySize]byte
+		copy(contentKeyArray[:], contentKeyBytes)
+		return OpenWholeAttachment(body, SecretboxKey(&contentKeyArray), verifyKey, zeroAttachmentNonce())
+	}
+	return nil, NewAttachmentError(BadSecretbox, "no recipient header entry could be opened with this key")
+}
+
+// zeroAttachmentNonce is the all-zero nonce this package's own design
+// notes say is safe for one-time keys; the content key generated by
+// SealAttachmentForRecipients is exactly that.
+func zeroAttachmentNonce() AttachmentNonce {
+	var nonce [AttachmentNonceSize]byte
+	return &nonce
+}
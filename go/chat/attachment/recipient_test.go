@@ -0,0 +1,75 @@
+package attachment
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+func testBoxKeyPair(t *testing.T) (pub, priv *[32]byte) {
+	t.Helper()
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub, priv
+}
+
+func TestSealAttachmentForRecipientsRoundTrip(t *testing.T) {
+	plaintext := []byte("this attachment is for a couple of specific people")
+	_, signKey, verifyKey := testKeys(t)
+
+	alicePub, alicePriv := testBoxKeyPair(t)
+	bobPub, bobPriv := testBoxKeyPair(t)
+
+	header, body, err := SealAttachmentForRecipients(plaintext, signKey, []*[32]byte{alicePub, bobPub})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, priv := range map[string]*[32]byte{"alice": alicePriv, "bob": bobPriv} {
+		opened, err := OpenAttachmentForRecipient(header, body, priv, verifyKey)
+		if err != nil {
+			t.Fatalf("%s: OpenAttachmentForRecipient failed: %s", name, err)
+		}
+		if !bytes.Equal(opened, plaintext) {
+			t.Fatalf("%s: round-tripped plaintext didn't match", name)
+		}
+	}
+}
+
+func TestOpenAttachmentForRecipientRejectsWrongKey(t *testing.T) {
+	plaintext := []byte("only alice should be able to read this")
+	_, signKey, verifyKey := testKeys(t)
+
+	alicePub, _ := testBoxKeyPair(t)
+	_, mallorysPriv := testBoxKeyPair(t)
+
+	header, body, err := SealAttachmentForRecipients(plaintext, signKey, []*[32]byte{alicePub})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenAttachmentForRecipient(header, body, mallorysPriv, verifyKey); err == nil {
+		t.Fatal("expected an error opening with a private key that isn't a recipient, got none")
+	}
+}
+
+func TestOpenAttachmentForRecipientDetectsTamperedBody(t *testing.T) {
+	plaintext := []byte("tamper with the body, not the header")
+	_, signKey, verifyKey := testKeys(t)
+	alicePub, alicePriv := testBoxKeyPair(t)
+
+	header, body, err := SealAttachmentForRecipients(plaintext, signKey, []*[32]byte{alicePub})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tamperedBody := append([]byte{}, body...)
+	tamperedBody[len(tamperedBody)-1] ^= 0xff
+
+	if _, err := OpenAttachmentForRecipient(header, tamperedBody, alicePriv, verifyKey); err == nil {
+		t.Fatal("expected an error opening a tampered body, got none")
+	}
+}
@@ -0,0 +1,159 @@
+package attachment
+
+import (
+	"errors"
+	"io"
+)
+
+// This file adapts the AttachmentEncoder/AttachmentDecoder chunk-buffering
+// API above to the standard io.Writer/io.Reader interfaces, the same way
+// golang.org/x/crypto/ssh wraps its cipher packet framing so that the rest
+// of the stdlib (io.Copy, http bodies, tar/zip streams, ...) can drive it
+// without knowing anything about chunk boundaries.
+
+// SealWriter wraps an AttachmentEncoder as an io.WriteCloser. Writes are
+// sealed and forwarded to the underlying io.Writer as soon as a full chunk
+// is available; Close() flushes the final (possibly empty) chunk.
+//
+// Write always consumes its entire input into the encoder before it ever
+// touches the underlying io.Writer, so a failed forwarding write can't be
+// retried the way io.Writer's contract normally allows: the plaintext is
+// already sealed and chunkNum already advanced. A Write that returns an
+// error poisons the SealWriter the same way Close does, so callers can't
+// accidentally re-feed the same bytes and desync the stream.
+type SealWriter struct {
+	w       io.Writer
+	encoder *AttachmentEncoder
+	closed  bool
+}
+
+// NewSealWriter returns an io.WriteCloser that seals everything written to
+// it with the given keys and nonce and forwards the sealed bytes to w.
+// Callers must call Close() when they're done; writing to a closed
+// SealWriter returns an error.
+func NewSealWriter(w io.Writer, encKey SecretboxKey, signKey SignKey, nonce AttachmentNonce) io.WriteCloser {
+	return &SealWriter{
+		w:       w,
+		encoder: NewAttachmentEncoder(encKey, signKey, nonce),
+	}
+}
+
+// Write always reports the full len(plaintext) as consumed, even on error:
+// the bytes are already sealed into the encoder's internal state by the
+// time the forwarding write to w is attempted, so there's no unwritten
+// suffix for a caller to retry. A failed Write poisons the SealWriter (like
+// Close does), since retrying would re-seal already-consumed plaintext and
+// corrupt the sealed stream with duplicate chunks.
+func (s *SealWriter) Write(plaintext []byte) (int, error) {
+	if s.closed {
+		return 0, errors.New("attachment: Write called on a closed SealWriter")
+	}
+	if packet := s.encoder.Write(plaintext); len(packet) > 0 {
+		if _, err := s.w.Write(packet); err != nil {
+			s.closed = true
+			return len(plaintext), err
+		}
+	}
+	return len(plaintext), nil
+}
+
+// Close flushes the final chunk. It's an error to call Write after Close,
+// or after a Write that returned an error.
+func (s *SealWriter) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	packet := s.encoder.Finish()
+	if len(packet) == 0 {
+		return nil
+	}
+	_, err := s.w.Write(packet)
+	return err
+}
+
+// OpenReader wraps an AttachmentDecoder as an io.Reader. It reads sealed
+// bytes from the underlying io.Reader on demand, opening chunks as they
+// become available and surfacing the plaintext through Read in the usual
+// read-until-EOF fashion.
+type OpenReader struct {
+	r        io.Reader
+	decoder  *AttachmentDecoder
+	readBuf  []byte
+	plain    []byte
+	finished bool
+	err      error
+}
+
+// NewOpenReader returns an io.Reader that reads sealed bytes from r,
+// verifies and decrypts them with the given keys and nonce, and yields the
+// plaintext. Truncation (the underlying reader ending mid-chunk or without
+// a final short chunk) is reported as io.ErrUnexpectedEOF; other integrity
+// failures (bad signature, malformed framing) are returned as the usual
+// AttachmentCryptoError.
+func NewOpenReader(r io.Reader, encKey SecretboxKey, verifyKey VerifyKey, nonce AttachmentNonce) io.Reader {
+	return &OpenReader{
+		r:       r,
+		decoder: NewAttachmentDecoder(encKey, verifyKey, nonce),
+		readBuf: make([]byte, PlaintextChunkLength),
+	}
+}
+
+func (o *OpenReader) Read(p []byte) (int, error) {
+	for len(o.plain) == 0 {
+		if o.err != nil {
+			return 0, o.err
+		}
+		if o.finished {
+			return 0, io.EOF
+		}
+		n, readErr := o.r.Read(o.readBuf)
+		if n > 0 {
+			plaintext, err := o.decoder.Write(o.readBuf[:n])
+			if err != nil {
+				o.err = truncationAwareError(err)
+				return 0, o.err
+			}
+			o.plain = append(o.plain, plaintext...)
+		}
+		switch readErr {
+		case nil:
+			// Keep looping until the underlying reader reports EOF; it's
+			// allowed to return (0, nil) or short reads along the way.
+		case io.EOF:
+			o.finished = true
+			plaintext, err := o.decoder.Finish()
+			if err != nil {
+				o.err = truncationAwareError(err)
+				return 0, o.err
+			}
+			o.plain = append(o.plain, plaintext...)
+		default:
+			o.err = readErr
+			return 0, o.err
+		}
+	}
+	n := copy(p, o.plain)
+	o.plain = o.plain[n:]
+	return n, nil
+}
+
+// truncationAwareError maps the framing errors that show up when a sealed
+// stream was cut short into io.ErrUnexpectedEOF, the same signal io.Copy
+// and friends already know how to handle. A short/incomplete final packet
+// always fails the bin32 framing check in unpackCiphertext before it ever
+// reaches the AEAD, since every full-length packet is fed to openPacket in
+// one piece (see AttachmentDecoder.Write/Finish) — so ShortMessagePackObject
+// and WrongMessagePackLength are the truncation signals. A BadSecretbox
+// failure means the framing was intact but the AEAD tag didn't verify: that's
+// tampering or the wrong key, not a short stream, so it's returned unchanged
+// along with every other integrity failure (a bad signature, for instance).
+func truncationAwareError(err error) error {
+	if attachmentErr, ok := err.(AttachmentCryptoError); ok {
+		switch attachmentErr.Type {
+		case ShortMessagePackObject, WrongMessagePackLength:
+			return io.ErrUnexpectedEOF
+		}
+	}
+	return err
+}
@@ -0,0 +1,98 @@
+package attachment
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestSealWriterOpenReaderRoundTrip(t *testing.T) {
+	encKey, signKey, verifyKey := testKeys(t)
+	nonce := testNonce(t)
+	plaintext := bytes.Repeat([]byte("stream bytes "), 100000) // multiple chunks
+
+	var sealed bytes.Buffer
+	w := NewSealWriter(&sealed, encKey, signKey, nonce)
+	if _, err := w.Write(plaintext); err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %s", err)
+	}
+
+	r := NewOpenReader(&sealed, encKey, verifyKey, nonce)
+	opened, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %s", err)
+	}
+	if !bytes.Equal(opened, plaintext) {
+		t.Fatal("round-tripped plaintext didn't match")
+	}
+}
+
+func TestOpenReaderDetectsTampering(t *testing.T) {
+	encKey, signKey, verifyKey := testKeys(t)
+	nonce := testNonce(t)
+	plaintext := []byte("don't modify me")
+
+	sealed := SealWholeAttachment(plaintext, encKey, signKey, nonce)
+	sealed[len(sealed)-1] ^= 0xff
+
+	r := NewOpenReader(bytes.NewReader(sealed), encKey, verifyKey, nonce)
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Fatal("expected an error reading a tampered stream, got none")
+	}
+}
+
+func TestOpenReaderDetectsTruncation(t *testing.T) {
+	encKey, signKey, verifyKey := testKeys(t)
+	nonce := testNonce(t)
+	plaintext := bytes.Repeat([]byte("x"), 2*PlaintextChunkLength)
+
+	sealed := SealWholeAttachment(plaintext, encKey, signKey, nonce)
+	truncated := sealed[:len(sealed)-10]
+
+	r := NewOpenReader(bytes.NewReader(truncated), encKey, verifyKey, nonce)
+	_, err := ioutil.ReadAll(r)
+	if err == nil {
+		t.Fatal("expected an error reading a truncated stream, got none")
+	}
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected io.ErrUnexpectedEOF for a truncated stream, got %s", err)
+	}
+}
+
+// failingWriter returns an error on every Write, to exercise SealWriter's
+// poison-on-failed-forwarding-write behavior.
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("simulated write failure")
+}
+
+func TestSealWriterPoisonsAfterFailedWrite(t *testing.T) {
+	encKey, signKey, _ := testKeys(t)
+	nonce := testNonce(t)
+
+	w := NewSealWriter(failingWriter{}, encKey, signKey, nonce)
+	// A full chunk, so the encoder actually has a packet ready to forward.
+	plaintext := bytes.Repeat([]byte("y"), PlaintextChunkLength)
+	n, err := w.Write(plaintext)
+	if err == nil {
+		t.Fatal("expected the forwarding write to fail, got no error")
+	}
+	if n != len(plaintext) {
+		t.Fatalf("expected Write to report all %d bytes consumed even on error, got %d", len(plaintext), n)
+	}
+
+	// The SealWriter should now be poisoned: further use is rejected instead
+	// of silently re-sealing (and desyncing) the stream.
+	if _, err := w.Write([]byte("more")); err == nil {
+		t.Fatal("expected Write after a failed write to return an error")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("expected Close after a failed write to be a no-op, got %s", err)
+	}
+}